@@ -9,14 +9,18 @@ package countminsketch
 
 import (
 	"bytes"
+	"compress/flate"
 	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"hash"
+	"hash/crc32"
 	"hash/fnv"
 	"io"
+	"io/ioutil"
 	"math"
 	"os"
+	"sort"
 )
 
 // CountMinSketch struct. d is the number of hashing functions,
@@ -24,11 +28,21 @@ import (
 // count, a matrix, is used to store the count.
 // uint is used to store count, the maximum count is 1<<32-1 in
 // 32 bit OS, and 1<<64-1 in 64 bit OS.
+// rowSum holds the total mass added to each row, used by EstimateCMM to
+// de-noise estimates. kind, newHash64/newHash128 and hasher/hasher128
+// record which hashing strategy this sketch uses, see NewWithHasher and
+// NewWith128.
 type CountMinSketch struct {
 	d      uint
 	w      uint
 	count  [][]uint64
-	hasher hash.Hash64
+	rowSum []uint64
+
+	kind       hasherKind
+	newHash64  func() hash.Hash64
+	newHash128 func() hash.Hash
+	hasher     hash.Hash64
+	hasher128  hash.Hash
 }
 
 // New creates a new Count-Min Sketch with _d_ hashing functions
@@ -39,14 +53,17 @@ func New(d uint, w uint) (s *CountMinSketch, err error) {
 	}
 
 	s = &CountMinSketch{
-		d:      d,
-		w:      w,
-		hasher: fnv.New64(),
+		d:         d,
+		w:         w,
+		kind:      hasherFNV64,
+		newHash64: fnv.New64,
+		hasher:    fnv.New64(),
 	}
 	s.count = make([][]uint64, d)
 	for r := uint(0); r < d; r++ {
 		s.count[r] = make([]uint64, w)
 	}
+	s.rowSum = make([]uint64, d)
 
 	return s, nil
 }
@@ -92,28 +109,39 @@ func (s *CountMinSketch) W() uint {
 	return s.w
 }
 
-// get the two basic hash function values for data.
-// Based on https://github.com/willf/bloom/blob/master/bloom.go
-func (s *CountMinSketch) baseHashes(key []byte) (a uint32, b uint32) {
+// baseHashes returns the two independent 64-bit values h1, h2 that
+// locations combines via Kirsch-Mitzenmacher double hashing. For a
+// 128-bit hasher these are the two halves of a single sum; for a
+// hash.Hash64 (FNV-64 by default) they are two hashes of the key, the
+// second prefixed with locationSalt.
+func (s *CountMinSketch) baseHashes(key []byte) (h1, h2 uint64) {
+	if s.kind == hasherHash128 {
+		s.hasher128.Reset()
+		s.hasher128.Write(key)
+		sum := s.hasher128.Sum(nil)
+		h1 = binary.BigEndian.Uint64(sum[0:8])
+		h2 = binary.BigEndian.Uint64(sum[8:16])
+		return
+	}
+
 	s.hasher.Reset()
 	s.hasher.Write(key)
-	sum := s.hasher.Sum(nil)
-	upper := sum[0:4]
-	lower := sum[4:8]
-	a = binary.BigEndian.Uint32(lower)
-	b = binary.BigEndian.Uint32(upper)
+	h1 = s.hasher.Sum64()
+
+	s.hasher.Reset()
+	s.hasher.Write(locationSalt)
+	s.hasher.Write(key)
+	h2 = s.hasher.Sum64()
 	return
 }
 
 // Get the _w_ locations to update/Estimate
-// Based on https://github.com/willf/bloom/blob/master/bloom.go
 func (s *CountMinSketch) locations(key []byte) (locs []uint) {
 	locs = make([]uint, s.d)
-	a, b := s.baseHashes(key)
-	ua := uint(a)
-	ub := uint(b)
+	h1, h2 := s.baseHashes(key)
+	w := uint64(s.w)
 	for r := uint(0); r < s.d; r++ {
-		locs[r] = (ua + ub*r) % s.w
+		locs[r] = uint((h1 + uint64(r)*h2) % w)
 	}
 	return
 }
@@ -122,6 +150,7 @@ func (s *CountMinSketch) locations(key []byte) (locs []uint) {
 func (s *CountMinSketch) Update(key []byte, count uint64) {
 	for r, c := range s.locations(key) {
 		s.count[r][c] += count
+		s.rowSum[r] += count
 	}
 }
 
@@ -146,7 +175,58 @@ func (s *CountMinSketch) EstimateString(key string) uint64 {
 	return s.Estimate([]byte(key))
 }
 
-// Merge combines this CountMinSketch with another one
+// EstimateCMM estimates the frequency of a key using the Count-Mean-Min
+// estimator. For each of the d rows it subtracts the expected noise
+// contributed by the other keys hashed into that row's cell,
+// (rowSum-v)/(w-1), from the counted value v, then returns the median of
+// the d de-noised values, clamped to [0, Estimate(key)]. This trades one
+// extra addition per Update for estimates with much less bias than plain
+// Estimate on heavy-tailed distributions, where a handful of hot keys
+// cause ordinary min-query to be thrown off by collisions.
+func (s *CountMinSketch) EstimateCMM(key []byte) uint64 {
+	upperBound := s.Estimate(key)
+	if s.w <= 1 {
+		return upperBound
+	}
+
+	locs := s.locations(key)
+	estimates := make([]float64, len(locs))
+	for r, c := range locs {
+		v := float64(s.count[r][c])
+		noise := (float64(s.rowSum[r]) - v) / float64(s.w-1)
+		e := v - noise
+		if e < 0 {
+			e = 0
+		}
+		estimates[r] = e
+	}
+	sort.Float64s(estimates)
+
+	mid := len(estimates) / 2
+	var median float64
+	if len(estimates)%2 == 0 {
+		median = (estimates[mid-1] + estimates[mid]) / 2
+	} else {
+		median = estimates[mid]
+	}
+
+	result := uint64(math.Round(median))
+	if result > upperBound {
+		result = upperBound
+	}
+	return result
+}
+
+// EstimateCMMString estimates the frequency of a key of string using the
+// Count-Mean-Min estimator. See EstimateCMM.
+func (s *CountMinSketch) EstimateCMMString(key string) uint64 {
+	return s.EstimateCMM([]byte(key))
+}
+
+// Merge combines this CountMinSketch with another one. Both sketches must
+// share the same dimensions and hasher kind -- summing cells produced by
+// different hash functions would silently combine unrelated locations
+// into meaningless counts.
 func (s *CountMinSketch) Merge(other *CountMinSketch) error {
 	if s.d != other.d {
 		return errors.New("countminsketch: matrix depth must match")
@@ -156,10 +236,15 @@ func (s *CountMinSketch) Merge(other *CountMinSketch) error {
 		return errors.New("countminsketch: matrix width must match")
 	}
 
+	if s.kind != other.kind {
+		return errors.New("countminsketch: hasher kind must match")
+	}
+
 	for i := uint(0); i < s.d; i++ {
 		for j := uint(0); j < s.w; j++ {
 			s.count[i][j] += other.count[i][j]
 		}
+		s.rowSum[i] += other.rowSum[i]
 	}
 
 	return nil
@@ -189,67 +274,85 @@ func (s *CountMinSketch) UnmarshalJSON(data []byte) error {
 	s.d = j.D
 	s.w = j.W
 	s.count = j.Count
+	s.kind = hasherFNV64
+	s.newHash64 = fnv.New64
 	s.hasher = fnv.New64()
+	s.newHash128 = nil
+	s.hasher128 = nil
+	s.rebuildRowSums()
 	return nil
 }
 
-// WriteTo writes a binary representation of the CountMinSketch to an i/o stream.
-// Based on https://github.com/willf/bloom/blob/master/bloom.go
-func (s *CountMinSketch) WriteTo(stream io.Writer) (int64, error) {
-	err := binary.Write(stream, binary.BigEndian, uint64(s.d))
-	if err != nil {
-		return 0, err
-	}
-	err = binary.Write(stream, binary.BigEndian, uint64(s.w))
-	if err != nil {
-		return 0, err
-	}
-
-	C := make([]uint64, s.w)
+// rebuildRowSums recomputes rowSum from count, for use after the matrix
+// has been loaded from a representation (JSON, the binary format) that
+// doesn't carry rowSum itself.
+func (s *CountMinSketch) rebuildRowSums() {
+	s.rowSum = make([]uint64, s.d)
 	for r := uint(0); r < s.d; r++ {
-		for c := uint(0); c < s.w; c++ {
-			C[c] = s.count[r][c]
+		for _, v := range s.count[r] {
+			s.rowSum[r] += v
 		}
-		err = binary.Write(stream, binary.BigEndian, C)
+	}
+}
+
+// WriteTo writes a versioned, checksummed binary representation of the
+// CountMinSketch to an i/o stream, compressing it first if that's
+// smaller. See the format comment in format.go for the exact layout.
+func (s *CountMinSketch) WriteTo(stream io.Writer) (int64, error) {
+	body := s.encodeBody()
+
+	var flags uint8
+	if len(body) >= compressMinBytes {
+		var compressed bytes.Buffer
+		fw, err := flate.NewWriter(&compressed, flate.DefaultCompression)
 		if err != nil {
 			return 0, err
 		}
+		if _, err = fw.Write(body); err != nil {
+			return 0, err
+		}
+		if err = fw.Close(); err != nil {
+			return 0, err
+		}
+		if compressed.Len() < len(body) {
+			body = compressed.Bytes()
+			flags |= flagCompressed
+		}
 	}
-	return int64(2*binary.Size(uint64(0)) + int(s.d)*binary.Size(C)), err
-}
 
-// ReadFrom a binary representation of the CountMinSketch from an i/o stream.
-// Based on https://github.com/willf/bloom/blob/master/bloom.go
-func (s *CountMinSketch) ReadFrom(stream io.Reader) (int64, error) {
-	var d, w uint64
-	err := binary.Read(stream, binary.BigEndian, &d)
-	if err != nil {
+	var out bytes.Buffer
+	out.WriteString(formatMagic)
+	out.WriteByte(formatVersion)
+	out.WriteByte(flags)
+	out.Write(body)
+	if err := binary.Write(&out, binary.BigEndian, crc32.Checksum(body, crc32cTable)); err != nil {
 		return 0, err
 	}
-	err = binary.Read(stream, binary.BigEndian, &w)
+
+	n, err := stream.Write(out.Bytes())
+	return int64(n), err
+}
+
+// ReadFrom reads a binary representation of the CountMinSketch written by
+// WriteTo. It recognizes the versioned format by its magic prefix and
+// otherwise falls back to the header-less layout written before that
+// format existed, so old dumps keep loading. Either way, the tagged
+// hasher kind must be the default (hasherFNV64) or match the hasher this
+// sketch was already configured with via NewWithHasher/NewWith128.
+func (s *CountMinSketch) ReadFrom(stream io.Reader) (int64, error) {
+	all, err := ioutil.ReadAll(stream)
 	if err != nil {
 		return 0, err
 	}
-	s.d = uint(d)
-	s.w = uint(w)
-
-	s.count = make([][]uint64, s.d)
-	for r := uint(0); r < s.d; r++ {
-		s.count[r] = make([]uint64, w)
-	}
 
-	C := make([]uint64, s.w)
-	for r := uint(0); r < s.d; r++ {
-		err = binary.Read(stream, binary.BigEndian, &C)
-		if err != nil {
+	if len(all) >= len(formatMagic) && string(all[:len(formatMagic)]) == formatMagic {
+		if err := s.readFromV1(all); err != nil {
 			return 0, err
 		}
-		for c := uint(0); c < s.w; c++ {
-			s.count[r][c] = C[c]
-		}
+		return int64(len(all)), nil
 	}
-	s.hasher = fnv.New64()
-	return int64(2*binary.Size(uint64(0)) + int(s.d)*binary.Size(C)), nil
+
+	return s.readFromLegacy(all)
 }
 
 // WriteToFile writes the Count-Min Sketch to file
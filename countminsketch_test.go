@@ -86,6 +86,39 @@ func TestIO(t *testing.T) {
 	}
 }
 
+func TestEstimateCMM(t *testing.T) {
+	s, err := New(4, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A handful of heavy hitters plus a long tail of noise, the setting
+	// where CMM is expected to beat plain Estimate.
+	truth := map[string]uint64{"a": 5000, "b": 3000, "c": 1000}
+	for k, v := range truth {
+		s.UpdateString(k, v)
+	}
+	for i := 0; i < 20000; i++ {
+		s.UpdateString(strconv.Itoa(i), 1)
+	}
+
+	for k, v := range truth {
+		cmm := s.EstimateCMMString(k)
+		plain := s.EstimateString(k)
+
+		if cmm > plain {
+			t.Errorf("EstimateCMM(%s)=%d should not exceed Estimate(%s)=%d", k, cmm, k, plain)
+		}
+		if cmm < v {
+			// CMM may slightly underestimate because it's no longer a
+			// strict upper bound, but it shouldn't be wildly off.
+			if v-cmm > v/10 {
+				t.Errorf("EstimateCMM(%s)=%d too far below truth %d", k, cmm, v)
+			}
+		}
+	}
+}
+
 func Benchmark_Update_ε0_001_δ0_999(b *testing.B) {
 	s, err := NewWithEstimates(0.001, 0.999)
 	if err != nil {
@@ -0,0 +1,107 @@
+package countminsketch
+
+import (
+	"math/rand"
+	"strconv"
+	"testing"
+)
+
+// zipfianCounts draws n samples from a Zipfian distribution over
+// [0, vocab) and returns both the per-item true counts and the draws
+// themselves, in draw order.
+func zipfianCounts(n, vocab int) (draws []int, truth map[int]uint64) {
+	r := rand.New(rand.NewSource(1))
+	z := rand.NewZipf(r, 1.5, 1, uint64(vocab-1))
+
+	draws = make([]int, n)
+	truth = make(map[int]uint64, vocab)
+	for i := 0; i < n; i++ {
+		v := int(z.Uint64())
+		draws[i] = v
+		truth[v]++
+	}
+	return
+}
+
+// TestCUOverestimation checks that, on a skewed (Zipfian) stream, the
+// conservative-update sketch never overestimates by more than the plain
+// CountMinSketch does, per key and in total.
+func TestCUOverestimation(t *testing.T) {
+	const d, w = 4, 256
+	draws, truth := zipfianCounts(20000, 2000)
+
+	cms, err := New(d, w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cu, err := NewCU(d, w)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, v := range draws {
+		key := []byte(strconv.Itoa(v))
+		cms.Update(key, 1)
+		cu.Update(key, 1)
+	}
+
+	var cmsErr, cuErr uint64
+	for v, c := range truth {
+		key := []byte(strconv.Itoa(v))
+
+		ce := cms.Estimate(key)
+		ue := cu.Estimate(key)
+
+		if ce < c {
+			t.Errorf("plain CMS underestimated key %d: got %d, want >= %d", v, ce, c)
+		}
+		if ue < c {
+			t.Errorf("CU sketch underestimated key %d: got %d, want >= %d", v, ue, c)
+		}
+		if ue > ce {
+			t.Errorf("CU sketch overestimated key %d more than plain CMS: cu=%d cms=%d", v, ue, ce)
+		}
+
+		cmsErr += ce - c
+		cuErr += ue - c
+	}
+
+	if cuErr > cmsErr {
+		t.Errorf("CU sketch total overestimation (%d) should not exceed plain CMS (%d)", cuErr, cmsErr)
+	}
+	t.Logf("total overestimation: cms=%d cu=%d", cmsErr, cuErr)
+}
+
+func TestCUMerge(t *testing.T) {
+	a, err := NewCU(4, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewCU(4, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a.UpdateString("x", 5)
+	b.UpdateString("x", 7)
+	b.UpdateString("y", 3)
+
+	if err := a.Merge(b); err != nil {
+		t.Fatal(err)
+	}
+
+	if v := a.EstimateString("x"); v < 7 {
+		t.Errorf("expected merged estimate for x >= 7, got %d", v)
+	}
+	if v := a.EstimateString("y"); v < 3 {
+		t.Errorf("expected merged estimate for y >= 3, got %d", v)
+	}
+
+	c, err := NewCU(4, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Merge(c); err == nil {
+		t.Error("expected error merging sketches with different width")
+	}
+}
@@ -0,0 +1,268 @@
+package countminsketch
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"os"
+)
+
+// ecmCell is one counter of an ECMSketch: a floating-point value and the
+// timestamp it was last touched (by a read or a write), so its decay can
+// be applied lazily.
+type ecmCell struct {
+	Value      float64
+	LastUpdate int64
+}
+
+// ECMSketch is an exponentially-decaying Count-Min Sketch. Each cell
+// holds a float64 value and the timestamp it was last touched; every read
+// or write first applies value *= exp(-lambda*(now-lastUpdate)) before
+// using it, so old mass fades away continuously rather than sitting
+// around forever. This answers "how frequent is this key recently",
+// which plain CountMinSketch has no notion of at all.
+type ECMSketch struct {
+	*CountMinSketch
+	lambda float64
+	cells  [][]ecmCell
+}
+
+// NewECM creates a new exponentially-decaying Count-Min Sketch with _d_
+// hashing functions, _w_ hash value range, and decay rate lambda (> 0;
+// larger values forget faster).
+func NewECM(d, w uint, lambda float64) (*ECMSketch, error) {
+	if lambda <= 0 {
+		return nil, errors.New("countminsketch: lambda should be greater than 0")
+	}
+
+	s, err := New(d, w)
+	if err != nil {
+		return nil, err
+	}
+
+	cells := make([][]ecmCell, d)
+	for r := uint(0); r < d; r++ {
+		cells[r] = make([]ecmCell, w)
+	}
+
+	return &ECMSketch{CountMinSketch: s, lambda: lambda, cells: cells}, nil
+}
+
+// decay applies cell's exponential decay up to now and updates its
+// timestamp, in place.
+func (s *ECMSketch) decay(cell *ecmCell, now int64) {
+	if cell.Value != 0 {
+		if dt := now - cell.LastUpdate; dt > 0 {
+			cell.Value *= math.Exp(-s.lambda * float64(dt))
+		}
+	}
+	cell.LastUpdate = now
+}
+
+// Update adds count to key's decayed estimate as of timestamp. This
+// shadows CountMinSketch.Update, which has no notion of time.
+func (s *ECMSketch) Update(key []byte, count uint64, timestamp int64) {
+	for r, c := range s.locations(key) {
+		cell := &s.cells[r][c]
+		s.decay(cell, timestamp)
+		cell.Value += float64(count)
+	}
+}
+
+// UpdateString adds count to a string key's decayed estimate as of
+// timestamp.
+func (s *ECMSketch) UpdateString(key string, count uint64, timestamp int64) {
+	s.Update([]byte(key), count, timestamp)
+}
+
+// Estimate returns key's decayed frequency estimate as of timestamp. This
+// shadows CountMinSketch.Estimate, which has no notion of time.
+func (s *ECMSketch) Estimate(key []byte, timestamp int64) float64 {
+	var min float64
+	for r, c := range s.locations(key) {
+		cell := &s.cells[r][c]
+		s.decay(cell, timestamp)
+		if r == 0 || cell.Value < min {
+			min = cell.Value
+		}
+	}
+	return min
+}
+
+// EstimateString returns a string key's decayed frequency estimate as of
+// timestamp.
+func (s *ECMSketch) EstimateString(key string, timestamp int64) float64 {
+	return s.Estimate([]byte(key), timestamp)
+}
+
+// Merge combines this ECMSketch with another one: every cell in both
+// sketches is first decayed up to timestamp, then summed. Both sketches
+// must share the same dimensions and decay rate.
+func (s *ECMSketch) Merge(other *ECMSketch, timestamp int64) error {
+	if s.d != other.d {
+		return errors.New("countminsketch: matrix depth must match")
+	}
+	if s.w != other.w {
+		return errors.New("countminsketch: matrix width must match")
+	}
+	if s.lambda != other.lambda {
+		return errors.New("countminsketch: decay rate (lambda) must match")
+	}
+
+	for i := uint(0); i < s.d; i++ {
+		for j := uint(0); j < s.w; j++ {
+			a := &s.cells[i][j]
+			b := &other.cells[i][j]
+			s.decay(a, timestamp)
+			s.decay(b, timestamp)
+			a.Value += b.Value
+		}
+	}
+	return nil
+}
+
+// ecmSketchJSON is the JSON struct of ECMSketch for marshal and
+// unmarshal.
+type ecmSketchJSON struct {
+	D      uint        `json:"d"`
+	W      uint        `json:"w"`
+	Lambda float64     `json:"lambda"`
+	Cells  [][]ecmCell `json:"cells"`
+}
+
+// MarshalJSON implements json.Marshaler interface.
+func (s *ECMSketch) MarshalJSON() ([]byte, error) {
+	return json.Marshal(ecmSketchJSON{D: s.d, W: s.w, Lambda: s.lambda, Cells: s.cells})
+}
+
+// UnmarshalJSON implements json.Unmarshaler interface.
+func (s *ECMSketch) UnmarshalJSON(data []byte) error {
+	var j ecmSketchJSON
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+
+	base, err := New(j.D, j.W)
+	if err != nil {
+		return err
+	}
+	s.CountMinSketch = base
+	s.lambda = j.Lambda
+	s.cells = j.Cells
+	return nil
+}
+
+// WriteTo writes a binary representation of the ECMSketch to an i/o
+// stream: d(8) w(8) lambda(8) followed by the d*w cells, each a
+// value(8)+lastUpdate(8) pair.
+func (s *ECMSketch) WriteTo(stream io.Writer) (int64, error) {
+	if err := binary.Write(stream, binary.BigEndian, uint64(s.d)); err != nil {
+		return 0, err
+	}
+	if err := binary.Write(stream, binary.BigEndian, uint64(s.w)); err != nil {
+		return 0, err
+	}
+	if err := binary.Write(stream, binary.BigEndian, s.lambda); err != nil {
+		return 0, err
+	}
+
+	for r := uint(0); r < s.d; r++ {
+		for c := uint(0); c < s.w; c++ {
+			cell := s.cells[r][c]
+			if err := binary.Write(stream, binary.BigEndian, cell.Value); err != nil {
+				return 0, err
+			}
+			if err := binary.Write(stream, binary.BigEndian, cell.LastUpdate); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return int64(3*8 + int(s.d)*int(s.w)*16), nil
+}
+
+// ReadFrom a binary representation of the ECMSketch from an i/o stream
+// written by WriteTo.
+func (s *ECMSketch) ReadFrom(stream io.Reader) (int64, error) {
+	var d, w uint64
+	var lambda float64
+	if err := binary.Read(stream, binary.BigEndian, &d); err != nil {
+		return 0, err
+	}
+	if err := binary.Read(stream, binary.BigEndian, &w); err != nil {
+		return 0, err
+	}
+	if err := binary.Read(stream, binary.BigEndian, &lambda); err != nil {
+		return 0, err
+	}
+
+	base, err := New(uint(d), uint(w))
+	if err != nil {
+		return 0, err
+	}
+	s.CountMinSketch = base
+	s.lambda = lambda
+
+	s.cells = make([][]ecmCell, d)
+	for r := range s.cells {
+		s.cells[r] = make([]ecmCell, w)
+		for c := range s.cells[r] {
+			var cell ecmCell
+			if err := binary.Read(stream, binary.BigEndian, &cell.Value); err != nil {
+				return 0, err
+			}
+			if err := binary.Read(stream, binary.BigEndian, &cell.LastUpdate); err != nil {
+				return 0, err
+			}
+			s.cells[r][c] = cell
+		}
+	}
+	return int64(3*8 + int(d)*int(w)*16), nil
+}
+
+// WriteToFile writes the ECMSketch to file.
+func (s *ECMSketch) WriteToFile(file string) (int64, error) {
+	fh, err := os.Create(file)
+	defer fh.Close()
+	if err != nil {
+		return 0, err
+	}
+	return s.WriteTo(fh)
+}
+
+// ReadFromFile reads the ECMSketch from file.
+func (s *ECMSketch) ReadFromFile(file string) (int64, error) {
+	fh, err := os.Open(file)
+	if err != nil {
+		return 0, err
+	}
+	defer fh.Close()
+	return s.ReadFrom(fh)
+}
+
+// NewECMFromFile creates a new ECMSketch from a file dumped by
+// WriteToFile.
+func NewECMFromFile(file string) (*ECMSketch, error) {
+	s := &ECMSketch{}
+	if _, err := s.ReadFromFile(file); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// GobEncode implements gob.GobEncoder interface.
+func (s *ECMSketch) GobEncode() ([]byte, error) {
+	var buf bytes.Buffer
+	if _, err := s.WriteTo(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// GobDecode implements gob.GobDecoder interface.
+func (s *ECMSketch) GobDecode(data []byte) error {
+	_, err := s.ReadFrom(bytes.NewBuffer(data))
+	return err
+}
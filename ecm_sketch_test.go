@@ -0,0 +1,86 @@
+package countminsketch
+
+import (
+	"bytes"
+	"math"
+	"testing"
+)
+
+func TestECMDecay(t *testing.T) {
+	// Choose lambda so that one half-life lands exactly on an integer
+	// timestamp (10): exp(-lambda*10) == 0.5.
+	lambda := math.Log(2) / 10
+	s, err := NewECM(4, 64, lambda)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.UpdateString("a", 10, 0)
+	if v := s.EstimateString("a", 0); v < 9.999 {
+		t.Errorf("expected ~10 immediately after update, got %f", v)
+	}
+
+	// After one half-life, the estimate should have roughly halved.
+	v := s.EstimateString("a", 10)
+	if v > 5.5 || v < 4.5 {
+		t.Errorf("expected estimate to roughly halve after one half-life, got %f", v)
+	}
+
+	// Long after the last update, the estimate should have decayed to
+	// (near) zero.
+	v = s.EstimateString("a", 1000)
+	if v > 0.01 {
+		t.Errorf("expected estimate to have decayed away, got %f", v)
+	}
+}
+
+func TestECMMerge(t *testing.T) {
+	a, err := NewECM(4, 64, 0.1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewECM(4, 64, 0.1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a.UpdateString("x", 5, 0)
+	b.UpdateString("x", 5, 0)
+
+	if err := a.Merge(b, 0); err != nil {
+		t.Fatal(err)
+	}
+	if v := a.EstimateString("x", 0); v < 9.999 {
+		t.Errorf("expected merged estimate ~10, got %f", v)
+	}
+
+	c, err := NewECM(4, 64, 0.2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Merge(c, 0); err == nil {
+		t.Error("expected error merging sketches with different lambda")
+	}
+}
+
+func TestECMIO(t *testing.T) {
+	s, err := NewECM(4, 64, 0.05)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.UpdateString("a", 7, 100)
+
+	var buf bytes.Buffer
+	if _, err := s.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := &ECMSketch{}
+	if _, err := loaded.ReadFrom(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := loaded.EstimateString("a", 100), s.EstimateString("a", 100); got != want {
+		t.Errorf("EstimateString after round trip = %f, want %f", got, want)
+	}
+}
@@ -0,0 +1,431 @@
+package countminsketch
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/bits"
+)
+
+// On-disk format written by WriteTo:
+//
+//	magic(4) version(1) flags(1) body crc32c(4)
+//
+// body is d(8) w(8) hasherKind(1) followed by the d rows of w counters.
+// Each row is self-describing (a tag byte, see rowTag*) so rows with
+// small values take far less than 8 bytes/counter, and the whole body may
+// be flate-compressed as a unit when that's smaller (flagCompressed).
+// crc32c covers body exactly as stored (i.e. after compression), so a
+// corrupted dump is caught on read rather than silently misparsed.
+//
+// ReadFrom recognizes this format by its magic prefix and otherwise falls
+// back to one of the two header-less layouts written before this format
+// existed, so old dumps keep loading:
+//
+//	pre-kind:  d(8) w(8) followed by d rows of w raw big-endian uint64s
+//	           (the very first format, from before hasher tagging existed)
+//	post-kind: d(8) w(8) hasherKind(1) followed by the same rows
+//
+// Both are exactly d*w*8 bytes of rows after their own header, so the
+// layout whose total length matches the buffer, given the d, w it
+// declares, is the one read.
+const (
+	formatMagic   = "CMSK"
+	formatVersion = 1
+
+	flagCompressed uint8 = 1 << 0
+
+	// compressMinBytes is the smallest uncompressed body worth trying to
+	// shrink with flate; below this the framing overhead isn't worth it.
+	compressMinBytes = 256
+)
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Row encodings, tagged with one leading byte so each row can pick
+// whichever is most compact for its own values.
+const (
+	// rowTagRaw64 stores w big-endian uint64s, 8 bytes each. Used when
+	// neither of the other encodings is smaller, e.g. a row with several
+	// very large counters.
+	rowTagRaw64 uint8 = iota
+	// rowTagVarint stores w binary.Uvarint-encoded uint64s back to back.
+	// Good for rows whose values vary widely in size.
+	rowTagVarint
+	// rowTagPacked stores a width byte (bits per counter, 0-32) followed
+	// by w values bit-packed at that width. Good for rows whose values
+	// are all of a similar, modest size -- the common case.
+	rowTagPacked
+)
+
+// encodeBody serializes d, w, the hasher kind tag and the count matrix
+// into a single buffer, ready to be optionally compressed by WriteTo.
+func (s *CountMinSketch) encodeBody() []byte {
+	var buf bytes.Buffer
+	var lenBuf [8]byte
+
+	binary.BigEndian.PutUint64(lenBuf[:], uint64(s.d))
+	buf.Write(lenBuf[:])
+	binary.BigEndian.PutUint64(lenBuf[:], uint64(s.w))
+	buf.Write(lenBuf[:])
+	buf.WriteByte(byte(s.kind))
+
+	for r := uint(0); r < s.d; r++ {
+		encodeRow(&buf, s.count[r])
+	}
+	return buf.Bytes()
+}
+
+// encodeRow appends row to buf, prefixed with its tag (and, for
+// rowTagPacked, its bit width). A row whose largest value fits in 32 bits
+// is always bit-packed, even where varint would be smaller; a wider row
+// uses varint when that is smaller than raw, and raw otherwise.
+func encodeRow(buf *bytes.Buffer, row []uint64) {
+	var max uint64
+	for _, v := range row {
+		if v > max {
+			max = v
+		}
+	}
+
+	width := 0
+	if max > 0 {
+		width = bits.Len64(max)
+	}
+
+	if width <= 32 {
+		buf.WriteByte(rowTagPacked)
+		buf.WriteByte(byte(width))
+		var bw bitWriter
+		for _, v := range row {
+			bw.writeBits(v, uint(width))
+		}
+		buf.Write(bw.flush())
+		return
+	}
+
+	var varintBuf bytes.Buffer
+	tmp := make([]byte, binary.MaxVarintLen64)
+	for _, v := range row {
+		n := binary.PutUvarint(tmp, v)
+		varintBuf.Write(tmp[:n])
+	}
+	if varintBuf.Len() < len(row)*8 {
+		buf.WriteByte(rowTagVarint)
+		buf.Write(varintBuf.Bytes())
+		return
+	}
+
+	buf.WriteByte(rowTagRaw64)
+	for _, v := range row {
+		binary.BigEndian.PutUint64(tmp[:8], v)
+		buf.Write(tmp[:8])
+	}
+}
+
+// decodeRow reads one row of w counters from c, in whichever encoding it
+// was tagged with.
+func decodeRow(c *byteCursor, w uint) ([]uint64, error) {
+	tag, err := c.readByte()
+	if err != nil {
+		return nil, err
+	}
+
+	row := make([]uint64, w)
+	switch tag {
+	case rowTagPacked:
+		widthByte, err := c.readByte()
+		if err != nil {
+			return nil, err
+		}
+		width := uint(widthByte)
+		nbytes := int((w*width + 7) / 8)
+		data, err := c.readN(nbytes)
+		if err != nil {
+			return nil, err
+		}
+		br := bitReader{buf: data}
+		for i := uint(0); i < w; i++ {
+			row[i] = br.readBits(width)
+		}
+	case rowTagVarint:
+		for i := uint(0); i < w; i++ {
+			v, err := c.readUvarint()
+			if err != nil {
+				return nil, err
+			}
+			row[i] = v
+		}
+	case rowTagRaw64:
+		for i := uint(0); i < w; i++ {
+			b, err := c.readN(8)
+			if err != nil {
+				return nil, err
+			}
+			row[i] = binary.BigEndian.Uint64(b)
+		}
+	default:
+		return nil, errors.New("countminsketch: unknown row encoding tag")
+	}
+	return row, nil
+}
+
+// bitWriter packs successive fixed-width values (width <= 32) into a
+// byte slice, LSB-first.
+type bitWriter struct {
+	buf  []byte
+	acc  uint64
+	nbit uint
+}
+
+func (bw *bitWriter) writeBits(v uint64, width uint) {
+	if width == 0 {
+		return
+	}
+	bw.acc |= (v & ((uint64(1) << width) - 1)) << bw.nbit
+	bw.nbit += width
+	for bw.nbit >= 8 {
+		bw.buf = append(bw.buf, byte(bw.acc))
+		bw.acc >>= 8
+		bw.nbit -= 8
+	}
+}
+
+func (bw *bitWriter) flush() []byte {
+	if bw.nbit > 0 {
+		bw.buf = append(bw.buf, byte(bw.acc))
+		bw.acc = 0
+		bw.nbit = 0
+	}
+	return bw.buf
+}
+
+// bitReader is the bitWriter counterpart: it unpacks successive
+// fixed-width values (width <= 32) from a byte slice, LSB-first.
+type bitReader struct {
+	buf  []byte
+	pos  int
+	acc  uint64
+	nbit uint
+}
+
+func (br *bitReader) readBits(width uint) uint64 {
+	if width == 0 {
+		return 0
+	}
+	for br.nbit < width {
+		var b byte
+		if br.pos < len(br.buf) {
+			b = br.buf[br.pos]
+			br.pos++
+		}
+		br.acc |= uint64(b) << br.nbit
+		br.nbit += 8
+	}
+	v := br.acc & ((uint64(1) << width) - 1)
+	br.acc >>= width
+	br.nbit -= width
+	return v
+}
+
+// byteCursor is a forward-only reader over an in-memory buffer, used to
+// decode a sketch body without needing explicit length prefixes between
+// fields.
+type byteCursor struct {
+	buf []byte
+	pos int
+}
+
+func (c *byteCursor) readByte() (byte, error) {
+	if c.pos >= len(c.buf) {
+		return 0, io.ErrUnexpectedEOF
+	}
+	b := c.buf[c.pos]
+	c.pos++
+	return b, nil
+}
+
+func (c *byteCursor) readN(n int) ([]byte, error) {
+	if c.pos+n > len(c.buf) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	b := c.buf[c.pos : c.pos+n]
+	c.pos += n
+	return b, nil
+}
+
+func (c *byteCursor) readUvarint() (uint64, error) {
+	v, n := binary.Uvarint(c.buf[c.pos:])
+	if n <= 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	c.pos += n
+	return v, nil
+}
+
+// checkHasherKind reports whether a hasher kind tag read from a stream is
+// compatible with s, without mutating s: the default (hasherFNV64) is
+// always compatible, anything else must already match what s was
+// constructed with (NewWithHasher, NewWith128), since a custom hash
+// function can't be reconstructed from its tag alone.
+func (s *CountMinSketch) checkHasherKind(kind hasherKind) error {
+	if kind != hasherFNV64 && kind != s.kind {
+		return errors.New("countminsketch: stream was written with a different hasher than this sketch is configured with")
+	}
+	return nil
+}
+
+// adoptHasherKind configures s to match a hasher kind tag already
+// validated by checkHasherKind. Call this only once the rest of a dump
+// has decoded successfully, alongside the other fields it's read with.
+func (s *CountMinSketch) adoptHasherKind(kind hasherKind) {
+	if kind == hasherFNV64 {
+		s.kind = hasherFNV64
+		s.newHash64 = fnv.New64
+		s.hasher = fnv.New64()
+		s.newHash128 = nil
+		s.hasher128 = nil
+	}
+}
+
+// decodeBody parses a body produced by encodeBody (after any
+// decompression) into local values, only copying them onto s once
+// decoding fully succeeds -- a truncated or corrupt body must never leave
+// s partially overwritten.
+func (s *CountMinSketch) decodeBody(body []byte) error {
+	c := &byteCursor{buf: body}
+
+	dBytes, err := c.readN(8)
+	if err != nil {
+		return err
+	}
+	wBytes, err := c.readN(8)
+	if err != nil {
+		return err
+	}
+	kindByte, err := c.readByte()
+	if err != nil {
+		return err
+	}
+	kind := hasherKind(kindByte)
+	if err := s.checkHasherKind(kind); err != nil {
+		return err
+	}
+
+	d := uint(binary.BigEndian.Uint64(dBytes))
+	w := uint(binary.BigEndian.Uint64(wBytes))
+
+	count := make([][]uint64, d)
+	for r := uint(0); r < d; r++ {
+		row, err := decodeRow(c, w)
+		if err != nil {
+			return err
+		}
+		count[r] = row
+	}
+
+	s.adoptHasherKind(kind)
+	s.d = d
+	s.w = w
+	s.count = count
+	s.rebuildRowSums()
+	return nil
+}
+
+// readFromV1 parses the versioned format (see the package-level format
+// comment above) out of a fully-buffered stream.
+func (s *CountMinSketch) readFromV1(all []byte) error {
+	if len(all) < len(formatMagic)+2+4 {
+		return errors.New("countminsketch: truncated sketch data")
+	}
+
+	version := all[len(formatMagic)]
+	if version != formatVersion {
+		return errors.New("countminsketch: unsupported format version")
+	}
+	flags := all[len(formatMagic)+1]
+
+	rest := all[len(formatMagic)+2:]
+	body := rest[:len(rest)-4]
+	wantCRC := binary.BigEndian.Uint32(rest[len(rest)-4:])
+	if gotCRC := crc32.Checksum(body, crc32cTable); gotCRC != wantCRC {
+		return errors.New("countminsketch: checksum mismatch, data is corrupt")
+	}
+
+	if flags&flagCompressed != 0 {
+		fr := flate.NewReader(bytes.NewReader(body))
+		defer fr.Close()
+		decompressed, err := ioutil.ReadAll(fr)
+		if err != nil {
+			return err
+		}
+		body = decompressed
+	}
+
+	return s.decodeBody(body)
+}
+
+// readFromLegacy parses one of the two header-less layouts written
+// before the versioned format existed (see the format comment at the top
+// of this file for the exact byte layouts), picking whichever one's total length matches
+// the d, w it declares in its first 16 bytes. Like decodeBody, it decodes
+// into local values and only copies them onto s once decoding fully
+// succeeds.
+func (s *CountMinSketch) readFromLegacy(all []byte) (int64, error) {
+	if len(all) < 16 {
+		return 0, errors.New("countminsketch: truncated sketch data")
+	}
+
+	d := binary.BigEndian.Uint64(all[0:8])
+	w := binary.BigEndian.Uint64(all[8:16])
+	if d == 0 || w == 0 || d > math.MaxInt32 || w > math.MaxInt32 {
+		return 0, errors.New("countminsketch: corrupt legacy sketch dimensions")
+	}
+	rowsLen := int64(d) * int64(w) * 8
+
+	var hasKind bool
+	var total int64
+	switch int64(len(all)) {
+	case 16 + rowsLen:
+		hasKind = false
+		total = 16 + rowsLen
+	case 16 + 1 + rowsLen:
+		hasKind = true
+		total = 16 + 1 + rowsLen
+	default:
+		return 0, errors.New("countminsketch: unrecognized legacy sketch layout")
+	}
+
+	pos := 16
+	kind := hasherFNV64
+	if hasKind {
+		kind = hasherKind(all[pos])
+		pos++
+	}
+	if err := s.checkHasherKind(kind); err != nil {
+		return 0, err
+	}
+
+	count := make([][]uint64, d)
+	for r := uint64(0); r < d; r++ {
+		row := make([]uint64, w)
+		for c := uint64(0); c < w; c++ {
+			row[c] = binary.BigEndian.Uint64(all[pos : pos+8])
+			pos += 8
+		}
+		count[r] = row
+	}
+
+	s.adoptHasherKind(kind)
+	s.d = uint(d)
+	s.w = uint(w)
+	s.count = count
+	s.rebuildRowSums()
+	return total, nil
+}
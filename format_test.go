@@ -0,0 +1,169 @@
+package countminsketch
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strconv"
+	"testing"
+)
+
+func TestFormatRoundTrip(t *testing.T) {
+	s, err := New(4, 2000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3000; i++ {
+		s.UpdateString(strconv.Itoa(i), uint64(i%50))
+	}
+
+	var buf bytes.Buffer
+	if _, err := s.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.HasPrefix(buf.Bytes(), []byte(formatMagic)) {
+		t.Fatalf("WriteTo output does not start with the format magic")
+	}
+
+	loaded, err := New(1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loaded.ReadFrom(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3000; i++ {
+		key := strconv.Itoa(i)
+		if s.EstimateString(key) != loaded.EstimateString(key) {
+			t.Fatalf("mismatch for key %s after round trip", key)
+		}
+	}
+}
+
+// TestFormatSparseIsCompact exercises a sketch most of whose cells are
+// zero, which should be compressed away, and checks it is much smaller
+// than 8 bytes/counter.
+func TestFormatSparseIsCompact(t *testing.T) {
+	s, err := New(4, 5000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.UpdateString("hot", 1)
+
+	var buf bytes.Buffer
+	if _, err := s.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	naive := 4 * 5000 * 8
+	if buf.Len() >= naive {
+		t.Errorf("expected compact encoding of a sparse sketch to beat the naive %d bytes, got %d", naive, buf.Len())
+	}
+}
+
+func TestFormatChecksumDetectsCorruption(t *testing.T) {
+	s, err := New(4, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.UpdateString("a", 1)
+
+	var buf bytes.Buffer
+	if _, err := s.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	data := buf.Bytes()
+	data[len(data)-5] ^= 0xff // flip a byte inside the body
+
+	loaded, err := New(1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loaded.ReadFrom(bytes.NewReader(data)); err == nil {
+		t.Error("expected checksum mismatch error after corrupting the dump")
+	}
+}
+
+// TestFormatReadsPreKindLegacyLayout checks that a dump in the very
+// first on-disk layout -- d(8) w(8) followed by the raw rows, with no
+// hasher kind byte at all, since pluggable hashing didn't exist yet --
+// still loads.
+func TestFormatReadsPreKindLegacyLayout(t *testing.T) {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, uint64(2)) // d
+	binary.Write(&buf, binary.BigEndian, uint64(4)) // w
+	binary.Write(&buf, binary.BigEndian, [4]uint64{1, 2, 3, 4})
+	binary.Write(&buf, binary.BigEndian, [4]uint64{5, 6, 7, 8})
+
+	loaded, err := New(1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loaded.ReadFrom(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+
+	if loaded.D() != 2 || loaded.W() != 4 {
+		t.Fatalf("unexpected dimensions after reading pre-kind legacy layout: d=%d w=%d", loaded.D(), loaded.W())
+	}
+	if loaded.count[0][0] != 1 || loaded.count[1][3] != 8 {
+		t.Fatalf("unexpected counts after reading pre-kind legacy layout: %v", loaded.count)
+	}
+}
+
+// TestFormatReadsPostKindLegacyLayout checks that a dump in the
+// header-less layout written once hasher tagging existed but before the
+// versioned format replaced it -- d(8) w(8) hasherKind(1) followed by the
+// raw rows -- still loads.
+func TestFormatReadsPostKindLegacyLayout(t *testing.T) {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, uint64(2)) // d
+	binary.Write(&buf, binary.BigEndian, uint64(4)) // w
+	buf.WriteByte(0)                                // hasherFNV64
+	binary.Write(&buf, binary.BigEndian, [4]uint64{1, 2, 3, 4})
+	binary.Write(&buf, binary.BigEndian, [4]uint64{5, 6, 7, 8})
+
+	loaded, err := New(1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loaded.ReadFrom(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+
+	if loaded.D() != 2 || loaded.W() != 4 {
+		t.Fatalf("unexpected dimensions after reading post-kind legacy layout: d=%d w=%d", loaded.D(), loaded.W())
+	}
+	if loaded.count[0][0] != 1 || loaded.count[1][3] != 8 {
+		t.Fatalf("unexpected counts after reading post-kind legacy layout: %v", loaded.count)
+	}
+}
+
+// TestFormatCorruptLegacyLeavesReceiverUntouched checks that a truncated
+// legacy-layout dump returns an error without partially overwriting a
+// sketch that already had data in it.
+func TestFormatCorruptLegacyLeavesReceiverUntouched(t *testing.T) {
+	s, err := New(2, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.UpdateString("a", 9)
+	before := s.EstimateString("a")
+
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, uint64(2)) // d
+	binary.Write(&buf, binary.BigEndian, uint64(4)) // w
+	buf.WriteByte(0)                                // hasherFNV64
+	binary.Write(&buf, binary.BigEndian, [4]uint64{1, 2, 3, 4})
+	// truncated: the second row is missing entirely
+
+	if _, err := s.ReadFrom(bytes.NewReader(buf.Bytes())); err == nil {
+		t.Fatal("expected error reading a truncated legacy dump")
+	}
+
+	if got := s.EstimateString("a"); got != before {
+		t.Fatalf("receiver was mutated by a failed ReadFrom: got %d, want %d", got, before)
+	}
+}
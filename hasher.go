@@ -0,0 +1,93 @@
+package countminsketch
+
+import (
+	"hash"
+)
+
+// hasherKind tags which hashing strategy a sketch uses, so the choice can
+// be persisted alongside the counts and validated when a dump is read
+// back in.
+type hasherKind uint8
+
+const (
+	// hasherFNV64 is the default, backward-compatible strategy: two
+	// independent 64-bit FNV-1 hashes of the key.
+	hasherFNV64 hasherKind = iota
+	// hasherHash64 uses a user-supplied hash.Hash64 constructor in place
+	// of FNV, following the same double-hashing scheme.
+	hasherHash64
+	// hasherHash128 uses a user-supplied 128-bit hash.Hash constructor,
+	// splitting its 16-byte sum into two independent 64-bit halves.
+	hasherHash128
+)
+
+// locationSalt is mixed in ahead of the key for the second of the two
+// 64-bit hashes computed from a hash.Hash64, so h1 and h2 don't collapse
+// to the same value.
+var locationSalt = []byte{0x9e}
+
+// NewWithHasher creates a new Count-Min Sketch with _d_ hashing functions
+// and _w_ hash value range, using newHash in place of the default FNV-64
+// to compute cell locations. Two independent 64-bit values h1, h2 are
+// derived from newHash (one of the key alone, one of the key prefixed
+// with a fixed salt) and combined via Kirsch-Mitzenmacher double hashing:
+// loc_r = (h1 + r*h2) mod w. Use this to trade hash speed for quality.
+func NewWithHasher(d, w uint, newHash func() hash.Hash64) (*CountMinSketch, error) {
+	s, err := New(d, w)
+	if err != nil {
+		return nil, err
+	}
+	s.kind = hasherHash64
+	s.newHash64 = newHash
+	s.hasher = newHash()
+	return s, nil
+}
+
+// NewWith128 creates a new Count-Min Sketch with _d_ hashing functions and
+// _w_ hash value range, using a 128-bit hash constructor newHash (e.g.
+// murmur3 or xxh3). Its 16-byte sum is split into two independent 64-bit
+// halves h1, h2 used directly for Kirsch-Mitzenmacher double hashing:
+// loc_r = (h1 + r*h2) mod w. Unlike the hash.Hash64 schemes, which hash
+// the key twice (once plain, once salted), this hashes it only once.
+func NewWith128(d, w uint, newHash func() hash.Hash) (*CountMinSketch, error) {
+	s, err := New(d, w)
+	if err != nil {
+		return nil, err
+	}
+	s.kind = hasherHash128
+	s.newHash128 = newHash
+	s.hasher128 = newHash()
+	return s, nil
+}
+
+// NewFromFileWithHasher creates a new Count-Min Sketch from a file dumped
+// by a sketch created with NewWithHasher, using newHash to recreate its
+// hasher. The file's tagged hasher kind must be hasherHash64 or the
+// default hasherFNV64 (in which case the returned sketch uses FNV-64);
+// any other kind makes ReadFrom return an error.
+func NewFromFileWithHasher(file string, newHash func() hash.Hash64) (*CountMinSketch, error) {
+	s, err := NewWithHasher(1, 1, newHash)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = s.ReadFromFile(file); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// NewFromFileWith128 creates a new Count-Min Sketch from a file dumped by
+// a sketch created with NewWith128, using newHash to recreate its hasher.
+// The file's tagged hasher kind must be hasherHash128 or the default
+// hasherFNV64 (in which case the returned sketch uses FNV-64); any other
+// kind makes ReadFrom return an error.
+func NewFromFileWith128(file string, newHash func() hash.Hash) (*CountMinSketch, error) {
+	s, err := NewWith128(1, 1, newHash)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = s.ReadFromFile(file); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
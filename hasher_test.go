@@ -0,0 +1,96 @@
+package countminsketch
+
+import (
+	"crypto/md5"
+	"hash"
+	"hash/crc64"
+	"os"
+	"strconv"
+	"testing"
+)
+
+func TestNewWithHasher(t *testing.T) {
+	crcTable := crc64.MakeTable(crc64.ISO)
+	s, err := NewWithHasher(4, 2000, func() hash.Hash64 {
+		return crc64.New(crcTable)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 1000; i++ {
+		s.UpdateString(strconv.Itoa(i), uint64(i))
+	}
+	for i := 0; i < 1000; i++ {
+		if v := s.EstimateString(strconv.Itoa(i)); v < uint64(i) {
+			t.Errorf("EstimateString(%d) = %d, want >= %d", i, v, i)
+		}
+	}
+}
+
+func TestNewWith128(t *testing.T) {
+	s, err := NewWith128(4, 2000, md5.New)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 1000; i++ {
+		s.UpdateString(strconv.Itoa(i), uint64(i))
+	}
+	for i := 0; i < 1000; i++ {
+		if v := s.EstimateString(strconv.Itoa(i)); v < uint64(i) {
+			t.Errorf("EstimateString(%d) = %d, want >= %d", i, v, i)
+		}
+	}
+}
+
+func TestHasherIOMismatch(t *testing.T) {
+	s, err := NewWith128(2, 100, md5.New)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.UpdateString("a", 1)
+
+	file := "hasher-io-mismatch-datafile"
+	if _, err := s.WriteToFile(file); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.Remove(file); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	if _, err := NewFromFile(file); err == nil {
+		t.Error("expected error reading a 128-bit-hashed dump as the default FNV sketch")
+	}
+
+	loaded, err := NewWith128(1, 1, md5.New)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loaded.ReadFromFile(file); err != nil {
+		t.Fatal(err)
+	}
+	if v := loaded.EstimateString("a"); v < 1 {
+		t.Errorf("EstimateString(a) = %d, want >= 1", v)
+	}
+}
+
+func TestHasherMergeMismatch(t *testing.T) {
+	a, err := New(4, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewWith128(4, 100, md5.New)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a.UpdateString("x", 5)
+	b.UpdateString("x", 7)
+
+	if err := a.Merge(b); err == nil {
+		t.Error("expected error merging sketches built with different hasher kinds")
+	}
+}
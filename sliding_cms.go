@@ -0,0 +1,351 @@
+package countminsketch
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+)
+
+// SlidingCMSketch tracks "recent" key frequencies over a sliding window of
+// duration W by keeping r rolling CountMinSketch slices, each covering an
+// epoch of W/r time units. Updates land in the slice for the current
+// epoch; as time advances past an epoch boundary, the oldest slice is
+// rotated out (reset) to make room for the new one. Queries sum all live
+// slices together, so the answer reflects only activity from (roughly)
+// the last W time units rather than a lifetime total.
+type SlidingCMSketch struct {
+	d         uint
+	w         uint
+	numSlices uint
+	window    int64
+	sliceSpan int64
+
+	slices       []*CountMinSketch
+	currentEpoch int64
+	haveEpoch    bool
+}
+
+// NewSlidingCMS creates a SlidingCMSketch with _d_ hashing functions, _w_
+// hash value range, numSlices rolling sub-sketches, over a sliding window
+// of window time units (in whatever unit the caller's timestamps use,
+// e.g. Unix seconds).
+func NewSlidingCMS(d, w, numSlices uint, window int64) (*SlidingCMSketch, error) {
+	if numSlices == 0 {
+		return nil, errors.New("countminsketch: numSlices should be greater than 0")
+	}
+	if window <= 0 {
+		return nil, errors.New("countminsketch: window should be greater than 0")
+	}
+	sliceSpan := window / int64(numSlices)
+	if sliceSpan <= 0 {
+		return nil, errors.New("countminsketch: window must be at least numSlices")
+	}
+
+	slices := make([]*CountMinSketch, numSlices)
+	for i := range slices {
+		sk, err := New(d, w)
+		if err != nil {
+			return nil, err
+		}
+		slices[i] = sk
+	}
+
+	return &SlidingCMSketch{
+		d:         d,
+		w:         w,
+		numSlices: numSlices,
+		window:    window,
+		sliceSpan: sliceSpan,
+		slices:    slices,
+	}, nil
+}
+
+// epochSlot maps an epoch number onto its ring-buffer slot.
+func (s *SlidingCMSketch) epochSlot(epoch int64) uint {
+	n := int64(s.numSlices)
+	return uint(((epoch % n) + n) % n)
+}
+
+// rotateTo advances the sketch's notion of "now" to epoch, resetting
+// (rotating out) any slices that fell outside the window as a result.
+func (s *SlidingCMSketch) rotateTo(epoch int64) {
+	if !s.haveEpoch {
+		s.currentEpoch = epoch
+		s.haveEpoch = true
+		return
+	}
+	if epoch <= s.currentEpoch {
+		return
+	}
+
+	advance := epoch - s.currentEpoch
+	if advance >= int64(s.numSlices) {
+		// every slice is now stale; reset them all and jump straight to epoch.
+		for i := range s.slices {
+			fresh, _ := New(s.d, s.w) // d, w already validated by NewSlidingCMS
+			s.slices[i] = fresh
+		}
+		s.currentEpoch = epoch
+		return
+	}
+
+	for e := s.currentEpoch + 1; e <= epoch; e++ {
+		fresh, _ := New(s.d, s.w)
+		s.slices[s.epochSlot(e)] = fresh
+	}
+	s.currentEpoch = epoch
+}
+
+// Update adds count to key's count in the slice for timestamp, rotating
+// out stale slices first. A timestamp older than the current window is
+// dropped.
+func (s *SlidingCMSketch) Update(key []byte, count uint64, timestamp int64) {
+	epoch := timestamp / s.sliceSpan
+	s.rotateTo(epoch)
+	if s.currentEpoch-epoch >= int64(s.numSlices) {
+		return
+	}
+	s.slices[s.epochSlot(epoch)].Update(key, count)
+}
+
+// UpdateString adds count to a string key's count in the slice for
+// timestamp.
+func (s *SlidingCMSketch) UpdateString(key string, count uint64, timestamp int64) {
+	s.Update([]byte(key), count, timestamp)
+}
+
+// Estimate returns key's estimated frequency over the trailing window
+// ending at timestamp, or at the latest epoch already seen if that is
+// later (the window never moves back): the live slices are merged into a
+// scratch sketch and queried as one.
+func (s *SlidingCMSketch) Estimate(key []byte, timestamp int64) uint64 {
+	epoch := timestamp / s.sliceSpan
+	s.rotateTo(epoch)
+
+	combined, _ := New(s.d, s.w) // d, w already validated by NewSlidingCMS
+	for _, sl := range s.slices {
+		_ = combined.Merge(sl) // dimensions always match by construction
+	}
+	return combined.Estimate(key)
+}
+
+// EstimateString returns a string key's estimated frequency over the
+// trailing window ending at timestamp.
+func (s *SlidingCMSketch) EstimateString(key string, timestamp int64) uint64 {
+	return s.Estimate([]byte(key), timestamp)
+}
+
+// Merge combines this SlidingCMSketch with another one as of timestamp:
+// both are rotated up to timestamp's epoch, then merged slot-wise. Both
+// sketches must share the same dimensions, slice count and window.
+func (s *SlidingCMSketch) Merge(other *SlidingCMSketch, timestamp int64) error {
+	if s.d != other.d || s.w != other.w {
+		return errors.New("countminsketch: matrix depth and width must match")
+	}
+	if s.numSlices != other.numSlices || s.window != other.window {
+		return errors.New("countminsketch: number of slices and window must match")
+	}
+
+	epoch := timestamp / s.sliceSpan
+	s.rotateTo(epoch)
+	other.rotateTo(epoch)
+
+	oldest := epoch - int64(s.numSlices) + 1
+	for e := oldest; e <= epoch; e++ {
+		idx := s.epochSlot(e)
+		if err := s.slices[idx].Merge(other.slices[idx]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// slidingCMSJSON is the JSON struct of SlidingCMSketch for marshal and
+// unmarshal.
+type slidingCMSJSON struct {
+	D            uint              `json:"d"`
+	W            uint              `json:"w"`
+	NumSlices    uint              `json:"numSlices"`
+	Window       int64             `json:"window"`
+	SliceSpan    int64             `json:"sliceSpan"`
+	CurrentEpoch int64             `json:"currentEpoch"`
+	HaveEpoch    bool              `json:"haveEpoch"`
+	Slices       []*CountMinSketch `json:"slices"`
+}
+
+// MarshalJSON implements json.Marshaler interface.
+func (s *SlidingCMSketch) MarshalJSON() ([]byte, error) {
+	return json.Marshal(slidingCMSJSON{
+		D:            s.d,
+		W:            s.w,
+		NumSlices:    s.numSlices,
+		Window:       s.window,
+		SliceSpan:    s.sliceSpan,
+		CurrentEpoch: s.currentEpoch,
+		HaveEpoch:    s.haveEpoch,
+		Slices:       s.slices,
+	})
+}
+
+// UnmarshalJSON implements json.Unmarshaler interface.
+func (s *SlidingCMSketch) UnmarshalJSON(data []byte) error {
+	var j slidingCMSJSON
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+
+	s.d = j.D
+	s.w = j.W
+	s.numSlices = j.NumSlices
+	s.window = j.Window
+	s.sliceSpan = j.SliceSpan
+	s.currentEpoch = j.CurrentEpoch
+	s.haveEpoch = j.HaveEpoch
+	s.slices = j.Slices
+	return nil
+}
+
+// WriteTo writes a binary representation of the SlidingCMSketch to an
+// i/o stream: d(8) w(8) numSlices(8) window(8) sliceSpan(8)
+// currentEpoch(8) haveEpoch(1), followed by each slice as a length-prefixed
+// CountMinSketch dump (length(8) + WriteTo output).
+func (s *SlidingCMSketch) WriteTo(stream io.Writer) (int64, error) {
+	var total int64
+	fields := []interface{}{
+		uint64(s.d), uint64(s.w), uint64(s.numSlices),
+		s.window, s.sliceSpan, s.currentEpoch,
+	}
+	for _, f := range fields {
+		if err := binary.Write(stream, binary.BigEndian, f); err != nil {
+			return total, err
+		}
+		total += 8
+	}
+
+	var haveEpoch uint8
+	if s.haveEpoch {
+		haveEpoch = 1
+	}
+	if err := binary.Write(stream, binary.BigEndian, haveEpoch); err != nil {
+		return total, err
+	}
+	total++
+
+	for _, sl := range s.slices {
+		var buf bytes.Buffer
+		if _, err := sl.WriteTo(&buf); err != nil {
+			return total, err
+		}
+		if err := binary.Write(stream, binary.BigEndian, uint64(buf.Len())); err != nil {
+			return total, err
+		}
+		total += 8
+		n, err := stream.Write(buf.Bytes())
+		total += int64(n)
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// ReadFrom a binary representation of the SlidingCMSketch from an i/o
+// stream written by WriteTo.
+func (s *SlidingCMSketch) ReadFrom(stream io.Reader) (int64, error) {
+	var total int64
+	var d, w, numSlices uint64
+	var window, sliceSpan, currentEpoch int64
+	var haveEpoch uint8
+
+	for _, f := range []interface{}{&d, &w, &numSlices, &window, &sliceSpan, &currentEpoch} {
+		if err := binary.Read(stream, binary.BigEndian, f); err != nil {
+			return total, err
+		}
+		total += 8
+	}
+	if err := binary.Read(stream, binary.BigEndian, &haveEpoch); err != nil {
+		return total, err
+	}
+	total++
+
+	s.d = uint(d)
+	s.w = uint(w)
+	s.numSlices = uint(numSlices)
+	s.window = window
+	s.sliceSpan = sliceSpan
+	s.currentEpoch = currentEpoch
+	s.haveEpoch = haveEpoch != 0
+
+	s.slices = make([]*CountMinSketch, s.numSlices)
+	for i := range s.slices {
+		var n uint64
+		if err := binary.Read(stream, binary.BigEndian, &n); err != nil {
+			return total, err
+		}
+		total += 8
+
+		buf := make([]byte, n)
+		if _, err := io.ReadFull(stream, buf); err != nil {
+			return total, err
+		}
+		total += int64(n)
+
+		sl, err := New(1, 1)
+		if err != nil {
+			return total, err
+		}
+		if _, err := sl.ReadFrom(bytes.NewReader(buf)); err != nil {
+			return total, err
+		}
+		s.slices[i] = sl
+	}
+	return total, nil
+}
+
+// WriteToFile writes the SlidingCMSketch to file.
+func (s *SlidingCMSketch) WriteToFile(file string) (int64, error) {
+	fh, err := os.Create(file)
+	defer fh.Close()
+	if err != nil {
+		return 0, err
+	}
+	return s.WriteTo(fh)
+}
+
+// ReadFromFile reads the SlidingCMSketch from file.
+func (s *SlidingCMSketch) ReadFromFile(file string) (int64, error) {
+	fh, err := os.Open(file)
+	if err != nil {
+		return 0, err
+	}
+	defer fh.Close()
+	return s.ReadFrom(fh)
+}
+
+// NewSlidingCMSFromFile creates a new SlidingCMSketch from a file dumped
+// by WriteToFile.
+func NewSlidingCMSFromFile(file string) (*SlidingCMSketch, error) {
+	s := &SlidingCMSketch{}
+	if _, err := s.ReadFromFile(file); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// GobEncode implements gob.GobEncoder interface.
+func (s *SlidingCMSketch) GobEncode() ([]byte, error) {
+	var buf bytes.Buffer
+	if _, err := s.WriteTo(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// GobDecode implements gob.GobDecoder interface.
+func (s *SlidingCMSketch) GobDecode(data []byte) error {
+	_, err := s.ReadFrom(bytes.NewBuffer(data))
+	return err
+}
@@ -0,0 +1,82 @@
+package countminsketch
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSlidingCMS(t *testing.T) {
+	// 4 slices over a 40-second window -> each slice covers 10 seconds.
+	s, err := NewSlidingCMS(4, 256, 4, 40)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.UpdateString("a", 1, 0)
+	if v := s.EstimateString("a", 5); v < 1 {
+		t.Errorf("expected a to still be counted at t=5, got %d", v)
+	}
+
+	// Advance well past the window; the update at t=0 should have rolled
+	// out of the sliding window by now.
+	if v := s.EstimateString("a", 100); v != 0 {
+		t.Errorf("expected a to have rolled out of the window, got %d", v)
+	}
+
+	// A fresh update should be counted again.
+	s.UpdateString("a", 1, 100)
+	if v := s.EstimateString("a", 105); v < 1 {
+		t.Errorf("expected a to be counted again after a fresh update, got %d", v)
+	}
+}
+
+func TestSlidingCMSMerge(t *testing.T) {
+	a, err := NewSlidingCMS(4, 256, 4, 40)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewSlidingCMS(4, 256, 4, 40)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a.UpdateString("x", 3, 0)
+	b.UpdateString("x", 4, 0)
+
+	if err := a.Merge(b, 0); err != nil {
+		t.Fatal(err)
+	}
+	if v := a.EstimateString("x", 0); v < 7 {
+		t.Errorf("expected merged estimate >= 7, got %d", v)
+	}
+
+	c, err := NewSlidingCMS(4, 256, 2, 40)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Merge(c, 0); err == nil {
+		t.Error("expected error merging sketches with different numSlices")
+	}
+}
+
+func TestSlidingCMSIO(t *testing.T) {
+	s, err := NewSlidingCMS(4, 256, 4, 40)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.UpdateString("a", 5, 10)
+
+	var buf bytes.Buffer
+	if _, err := s.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := &SlidingCMSketch{}
+	if _, err := loaded.ReadFrom(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := loaded.EstimateString("a", 10), s.EstimateString("a", 10); got != want {
+		t.Errorf("EstimateString after round trip = %d, want %d", got, want)
+	}
+}
@@ -0,0 +1,196 @@
+package countminsketch
+
+import (
+	"container/heap"
+	"encoding/json"
+	"errors"
+	"sort"
+)
+
+// Entry is a key and its estimated frequency, as returned by TopK.List.
+type Entry struct {
+	Key   []byte
+	Count uint64
+}
+
+// TopK tracks the k most frequent keys seen so far, using a CountMinSketch
+// to estimate frequencies and a min-heap (ordered by estimate) to keep
+// only the k largest around. Looking up or evicting a tracked key is
+// O(log k); Add is otherwise dominated by the cost of the underlying
+// sketch update.
+type TopK struct {
+	k      uint
+	sketch *CountMinSketch
+	heap   []*Entry
+	index  map[string]int // key -> position in heap
+}
+
+// NewTopK creates a TopK tracker backed by a CountMinSketch with _d_
+// hashing functions and _w_ hash value range, keeping the _k_ most
+// frequent keys.
+func NewTopK(d, w, k uint) (*TopK, error) {
+	if k <= 0 {
+		return nil, errors.New("countminsketch: k should be greater than 0")
+	}
+
+	s, err := New(d, w)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TopK{
+		k:      k,
+		sketch: s,
+		index:  make(map[string]int),
+	}, nil
+}
+
+// Len, Less, Swap, Push and Pop implement heap.Interface over the tracked
+// entries, ordered by ascending Count so the root is always the smallest
+// of the k entries currently kept.
+func (t *TopK) Len() int { return len(t.heap) }
+
+func (t *TopK) Less(i, j int) bool { return t.heap[i].Count < t.heap[j].Count }
+
+func (t *TopK) Swap(i, j int) {
+	t.heap[i], t.heap[j] = t.heap[j], t.heap[i]
+	t.index[string(t.heap[i].Key)] = i
+	t.index[string(t.heap[j].Key)] = j
+}
+
+func (t *TopK) Push(x interface{}) {
+	e := x.(*Entry)
+	t.index[string(e.Key)] = len(t.heap)
+	t.heap = append(t.heap, e)
+}
+
+func (t *TopK) Pop() interface{} {
+	old := t.heap
+	n := len(old)
+	e := old[n-1]
+	old[n-1] = nil
+	t.heap = old[:n-1]
+	delete(t.index, string(e.Key))
+	return e
+}
+
+// Add records an occurrence of key and updates the set of tracked top-k
+// keys: the underlying sketch is always updated, then the heap entry for
+// key is refreshed if it is already tracked, or key is inserted (evicting
+// the current smallest entry if the heap is already at capacity and key's
+// estimate beats it).
+func (t *TopK) Add(key []byte, count uint64) {
+	t.sketch.Update(key, count)
+	estimate := t.sketch.Estimate(key)
+
+	ks := string(key)
+	if i, ok := t.index[ks]; ok {
+		t.heap[i].Count = estimate
+		heap.Fix(t, i)
+		return
+	}
+
+	if uint(len(t.heap)) < t.k {
+		heap.Push(t, &Entry{Key: append([]byte(nil), key...), Count: estimate})
+		return
+	}
+
+	if estimate > t.heap[0].Count {
+		heap.Pop(t)
+		heap.Push(t, &Entry{Key: append([]byte(nil), key...), Count: estimate})
+	}
+}
+
+// AddString records an occurrence of a key of string.
+func (t *TopK) AddString(key string, count uint64) {
+	t.Add([]byte(key), count)
+}
+
+// List returns the tracked entries sorted by descending estimated count.
+func (t *TopK) List() []Entry {
+	entries := make([]Entry, len(t.heap))
+	for i, e := range t.heap {
+		entries[i] = Entry{Key: append([]byte(nil), e.Key...), Count: e.Count}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Count > entries[j].Count })
+	return entries
+}
+
+// Merge combines this TopK with another one: the underlying sketches are
+// merged additively, then the k largest keys across both trackers'
+// estimates (re-queried against the merged sketch) are kept.
+func (t *TopK) Merge(other *TopK) error {
+	if t.k != other.k {
+		return errors.New("countminsketch: k must match")
+	}
+	if err := t.sketch.Merge(other.sketch); err != nil {
+		return err
+	}
+
+	seen := make(map[string]bool, len(t.heap)+len(other.heap))
+	candidates := make([]*Entry, 0, len(t.heap)+len(other.heap))
+	for _, e := range t.heap {
+		seen[string(e.Key)] = true
+		candidates = append(candidates, &Entry{Key: e.Key, Count: t.sketch.Estimate(e.Key)})
+	}
+	for _, e := range other.heap {
+		ks := string(e.Key)
+		if seen[ks] {
+			continue
+		}
+		seen[ks] = true
+		candidates = append(candidates, &Entry{Key: e.Key, Count: t.sketch.Estimate(e.Key)})
+	}
+
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].Count > candidates[j].Count })
+	if uint(len(candidates)) > t.k {
+		candidates = candidates[:t.k]
+	}
+
+	t.heap = t.heap[:0]
+	t.index = make(map[string]int, len(candidates))
+	for _, e := range candidates {
+		heap.Push(t, e)
+	}
+	return nil
+}
+
+// topKJSON is the JSON struct of TopK for marshal and unmarshal.
+type topKJSON struct {
+	K      uint            `json:"k"`
+	Sketch *CountMinSketch `json:"sketch"`
+	Heap   []*Entry        `json:"heap"`
+}
+
+// MarshalJSON implements json.Marshaler interface.
+func (t *TopK) MarshalJSON() ([]byte, error) {
+	return json.Marshal(topKJSON{K: t.k, Sketch: t.sketch, Heap: t.heap})
+}
+
+// UnmarshalJSON implements json.Unmarshaler interface.
+func (t *TopK) UnmarshalJSON(data []byte) error {
+	var j topKJSON
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+
+	t.k = j.K
+	t.sketch = j.Sketch
+	t.heap = j.Heap
+	t.index = make(map[string]int, len(t.heap))
+	for i, e := range t.heap {
+		t.index[string(e.Key)] = i
+	}
+	heap.Init(t)
+	return nil
+}
+
+// GobEncode implements gob.GobEncoder interface.
+func (t *TopK) GobEncode() ([]byte, error) {
+	return t.MarshalJSON()
+}
+
+// GobDecode implements gob.GobDecoder interface.
+func (t *TopK) GobDecode(data []byte) error {
+	return t.UnmarshalJSON(data)
+}
@@ -0,0 +1,113 @@
+package countminsketch
+
+import (
+	"math/rand"
+	"strconv"
+	"testing"
+)
+
+func TestTopK(t *testing.T) {
+	topk, err := NewTopK(4, 256, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	topk.AddString("a", 100)
+	topk.AddString("b", 50)
+	topk.AddString("c", 10)
+	topk.AddString("d", 1)
+
+	entries := topk.List()
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 tracked keys, got %d", len(entries))
+	}
+	if string(entries[0].Key) != "a" || string(entries[1].Key) != "b" || string(entries[2].Key) != "c" {
+		t.Errorf("unexpected top-3 order: %+v", entries)
+	}
+
+	// Repeated additions to an already-tracked key should update, not
+	// duplicate, its entry.
+	topk.AddString("c", 200)
+	entries = topk.List()
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 tracked keys after update, got %d", len(entries))
+	}
+	if string(entries[0].Key) != "c" {
+		t.Errorf("expected c to become the top key, got %+v", entries)
+	}
+}
+
+func TestTopKMerge(t *testing.T) {
+	a, err := NewTopK(4, 256, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewTopK(4, 256, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a.AddString("x", 10)
+	a.AddString("y", 5)
+	b.AddString("x", 10)
+	b.AddString("z", 25)
+
+	if err := a.Merge(b); err != nil {
+		t.Fatal(err)
+	}
+
+	entries := a.List()
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 tracked keys after merge, got %d", len(entries))
+	}
+	if string(entries[0].Key) != "z" {
+		t.Errorf("expected z to be the top key after merge, got %+v", entries)
+	}
+
+	c, err := NewTopK(4, 256, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Merge(c); err == nil {
+		t.Error("expected error merging TopK trackers with different k")
+	}
+}
+
+func TestTopKIO(t *testing.T) {
+	topk, err := NewTopK(4, 256, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	topk.AddString("a", 100)
+	topk.AddString("b", 50)
+
+	data, err := topk.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := &TopK{}
+	if err := loaded.UnmarshalJSON(data); err != nil {
+		t.Fatal(err)
+	}
+
+	entries := loaded.List()
+	if len(entries) != 2 || string(entries[0].Key) != "a" {
+		t.Errorf("unexpected entries after round-trip: %+v", entries)
+	}
+}
+
+func BenchmarkTopKAddZipfian(b *testing.B) {
+	topk, err := NewTopK(4, 2048, 100)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	r := rand.New(rand.NewSource(1))
+	z := rand.NewZipf(r, 1.5, 1, 1<<16-1)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		topk.AddString(strconv.FormatUint(z.Uint64(), 10), 1)
+	}
+}